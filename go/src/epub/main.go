@@ -0,0 +1,382 @@
+// This file contains code to convert text files to EPUB3.
+// See README for the format of the text files.
+//
+// It reads the same formatted .txt input as the tex tool (title, author,
+// "+"-prefixed headings, "---" tables, parenthetical comments) and shares
+// the heading/comment parsing with it via internal/doc.
+//
+// Compile:
+//   cd ancient-chinese/go
+//   go install epub
+// Run
+//   bin/epub txt/shiji-simplified.txt
+// It generates a new file txt/shiji-simplified.epub
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"html"
+	"internal/doc"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var commentsMode = flag.String("comments", "inline", "How to render （…）comments: inline (span.note) or footnote (aside epub:type=\"footnote\").")
+var rubyReadings = flag.String("ruby-readings", "", "TSV file (character<TAB>reading) of bulk ruby/pinyin annotations for rare characters that aren't marked up inline (see doc.ReplaceRuby).")
+
+// section is one top-level (depth 0, "+") part of the book, rendered as
+// its own XHTML file inside the EPUB.
+type section struct {
+	id    string
+	title string
+	body  bytes.Buffer
+}
+
+func renderComment(comment string) string {
+	if *commentsMode == "footnote" {
+		return fmt.Sprintf(`<aside epub:type="footnote">%s</aside>`, comment)
+	}
+	return fmt.Sprintf(`<span class="note">%s</span>`, comment)
+}
+
+// renderRuby turns one inline or bulk ruby/pinyin annotation into proper
+// EPUB3 ruby markup.
+func renderRuby(char, reading string) string {
+	return fmt.Sprintf(`<ruby><rb>%s</rb><rt>%s</rt></ruby>`, char, reading)
+}
+
+// kCiteRefPattern matches the tex-only inline citation/cross-reference
+// tokens ([[cite:key]], [[ref:label]], [[see:label]]; see
+// tex.renderCiteRef) so stripCiteRef can neutralize them here instead.
+var kCiteRefPattern = regexp.MustCompile(`\[\[(?:cite|ref|see):([^\]]+)\]\]`)
+
+// stripCiteRef drops the tex-only [[cite:...]]/[[ref:...]]/[[see:...]]
+// markup, since the bibliography/cross-reference layer (tex.ConvertToTex)
+// has no EPUB equivalent; it keeps the bare key/label so the reference
+// isn't silently lost, rather than leaking the literal [[...]] syntax.
+func stripCiteRef(text string) string {
+	return kCiteRefPattern.ReplaceAllString(text, "$1")
+}
+
+// headingTag maps a heading depth (0..7, see doc.ParseTitleLine) to an
+// XHTML tag. XHTML only defines h1..h6, so paragraph/subparagraph (the
+// two deepest levels) are rendered as styled paragraphs instead.
+func headingTag(depth int) (open, close string) {
+	if depth < 6 {
+		tag := fmt.Sprintf("h%d", depth+1)
+		return "<" + tag + ">", "</" + tag + ">"
+	}
+	class := fmt.Sprintf("h%d", depth+1)
+	return fmt.Sprintf(`<p class="%s">`, class), "</p>"
+}
+
+func writeTable(body *bytes.Buffer, rows []string) {
+	if len(rows) == 0 {
+		return
+	}
+	body.WriteString("<table>\n")
+	for _, row := range rows {
+		body.WriteString("<tr>")
+		for _, column := range strings.Split(row, "|") {
+			fmt.Fprintf(body, "<td>%s</td>", html.EscapeString(column))
+		}
+		body.WriteString("</tr>\n")
+	}
+	body.WriteString("</table>\n")
+}
+
+func sectionXHTML(title string, body string) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>%s</title><meta charset="UTF-8"/></head>
+<body>
+%s
+</body>
+</html>`, html.EscapeString(title), body)
+}
+
+func coverXHTML(title, author string) string {
+	title, author = html.EscapeString(title), html.EscapeString(author)
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head><title>%s</title><meta charset="UTF-8"/></head>
+<body>
+<h1>%s</h1>
+<p>%s</p>
+</body>
+</html>`, title, title, author)
+}
+
+func contentOPF(title, author string, sections []*section) string {
+	var manifest, spine bytes.Buffer
+	fmt.Fprintln(&manifest, `    <item id="cover" href="cover.xhtml" media-type="application/xhtml+xml"/>`)
+	fmt.Fprintln(&manifest, `    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>`)
+	fmt.Fprintln(&manifest, `    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>`)
+	fmt.Fprintln(&spine, `    <itemref idref="cover"/>`)
+	for _, s := range sections {
+		fmt.Fprintf(&manifest, "    <item id=\"%s\" href=\"%s.xhtml\" media-type=\"application/xhtml+xml\"/>\n", s.id, s.id)
+		fmt.Fprintf(&spine, "    <itemref idref=\"%s\"/>\n", s.id)
+	}
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="book-id">%s</dc:identifier>
+    <dc:title>%s</dc:title>
+    <dc:creator>%s</dc:creator>
+    <dc:language>zh</dc:language>
+    <meta property="dcterms:modified">%s</meta>
+  </metadata>
+  <manifest>
+%s  </manifest>
+  <spine>
+%s  </spine>
+</package>`, bookIdentifier(title), html.EscapeString(title), html.EscapeString(author), modifiedTimestamp(), manifest.String(), spine.String())
+}
+
+func tocNCX(title string, sections []*section) string {
+	var navPoints bytes.Buffer
+	for i, s := range sections {
+		fmt.Fprintf(&navPoints, `    <navPoint id="navPoint-%d" playOrder="%d">
+      <navLabel><text>%s</text></navLabel>
+      <content src="%s.xhtml"/>
+    </navPoint>
+`, i+1, i+1, html.EscapeString(s.title), s.id)
+	}
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <head>
+    <meta name="dtb:uid" content="%s"/>
+  </head>
+  <docTitle><text>%s</text></docTitle>
+  <navMap>
+%s  </navMap>
+</ncx>`, bookIdentifier(title), html.EscapeString(title), navPoints.String())
+}
+
+func navXHTML(title string, sections []*section) string {
+	var items bytes.Buffer
+	for _, s := range sections {
+		fmt.Fprintf(&items, "      <li><a href=\"%s.xhtml\">%s</a></li>\n", s.id, html.EscapeString(s.title))
+	}
+	title = html.EscapeString(title)
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>%s</title><meta charset="UTF-8"/></head>
+<body>
+  <nav epub:type="toc" id="toc">
+    <h1>%s</h1>
+    <ol>
+%s    </ol>
+  </nav>
+</body>
+</html>`, title, title, items.String())
+}
+
+func slug(title string) string {
+	var buffer bytes.Buffer
+	for _, r := range title {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			buffer.WriteRune(r)
+		}
+	}
+	if buffer.Len() == 0 {
+		return "book"
+	}
+	return buffer.String()
+}
+
+// bookIdentifier returns the urn:uuid dc:identifier used for both
+// content.opf's unique-identifier and toc.ncx's matching dtb:uid, as
+// EPUB3/NCX require.
+func bookIdentifier(title string) string {
+	return "urn:uuid:" + slug(title)
+}
+
+// modifiedTimestamp returns the current time as the dcterms:modified
+// meta the EPUB3 OPF spec requires.
+func modifiedTimestamp() string {
+	return time.Now().UTC().Format("2006-01-02T15:04:05Z")
+}
+
+func writeStoredFile(writer *zip.Writer, name string, content []byte) error {
+	header := &zip.FileHeader{Name: name, Method: zip.Store}
+	entryWriter, err := writer.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = entryWriter.Write(content)
+	return err
+}
+
+func writeFile(writer *zip.Writer, name string, content string) error {
+	entryWriter, err := writer.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = entryWriter.Write([]byte(content))
+	return err
+}
+
+func ConvertToEpub(input, output string) {
+	// Open input.
+	inputFile, err := os.Open(input)
+	if err != nil {
+		log.Printf("Failed to open %s for read: %s.", input, err)
+		return
+	}
+	defer inputFile.Close()
+	inputScanner := bufio.NewScanner(inputFile)
+
+	var bulkReadings map[rune]string
+	if len(*rubyReadings) > 0 {
+		var err error
+		bulkReadings, err = doc.LoadCharacterReadings(*rubyReadings)
+		if err != nil {
+			log.Fatalf("Failed to load %s: %s.", *rubyReadings, err)
+		}
+	}
+	// renderText strips tex-only cite/ref tokens, HTML-escapes the plain
+	// text (none of the & < > " it touches appear in the syntaxes here),
+	// then resolves ruby annotations and（…）comments in a line of body or
+	// heading text, in that order since none of these syntaxes overlap.
+	renderText := func(text string) string {
+		return doc.ReplaceComment(doc.ReplaceRuby(html.EscapeString(stripCiteRef(text)), bulkReadings, renderRuby), renderComment)
+	}
+
+	var title, author string
+	var sections []*section
+	var current *section
+	const kTableMarker = "---"
+	const kRefsStart = "===refs==="
+	const kRefsEnd = "==="
+	// ensureSection returns current, lazily creating a "Front Matter"
+	// section the first time body content (a paragraph or table) shows up
+	// before the first "+" heading -- otherwise that front matter would be
+	// silently dropped here while tex keeps it. It needs a real title, not
+	// an empty one, so it doesn't show up as a blank, unlabeled entry in
+	// the EPUB's nav/TOC.
+	ensureSection := func() *section {
+		if current == nil {
+			log.Printf("No heading yet; creating a \"Front Matter\" section for content before the first \"+\" heading.")
+			sections = append(sections, &section{id: fmt.Sprintf("section%d", len(sections)+1), title: "Front Matter"})
+			current = sections[len(sections)-1]
+		}
+		return current
+	}
+	for inputScanner.Scan() {
+		line := strings.TrimSpace(inputScanner.Text())
+		if len(line) == 0 {
+			continue
+		} else if len(title) == 0 {
+			title = line
+			log.Printf("Title: %s\n", title)
+		} else if len(author) == 0 {
+			author = line
+			log.Printf("Author: %s\n", author)
+		} else if line == kRefsStart {
+			// The bibliography/cross-reference layer is TeX-only (see
+			// tex.ConvertToTex); just skip the raw BibTeX here so it
+			// doesn't end up rendered as stray paragraphs.
+			for inputScanner.Scan() {
+				if strings.TrimSpace(inputScanner.Text()) == kRefsEnd {
+					break
+				}
+			}
+		} else if line == kTableMarker {
+			var tableRows []string
+			for inputScanner.Scan() {
+				line = strings.TrimSpace(inputScanner.Text())
+				if line == kTableMarker {
+					break
+				}
+				tableRows = append(tableRows, line)
+			}
+			if len(tableRows) > 0 {
+				writeTable(&ensureSection().body, tableRows)
+			}
+		} else if line[0] == '+' {
+			sectionType, outTitle := doc.ParseTitleLine(line)
+			if sectionType == 0 || current == nil {
+				sections = append(sections, &section{
+					id:    fmt.Sprintf("section%d", len(sections)+1),
+					title: outTitle,
+				})
+				current = sections[len(sections)-1]
+				if sectionType != 0 {
+					open, close := headingTag(sectionType)
+					current.body.WriteString(open + renderText(outTitle) + close + "\n")
+				}
+				continue
+			}
+			open, close := headingTag(sectionType)
+			current.body.WriteString(open + renderText(outTitle) + close + "\n")
+		} else {
+			fmt.Fprintf(&ensureSection().body, "<p>%s</p>\n", renderText(line))
+		}
+	}
+
+	// Open output.
+	outputFile, err := os.Create(output)
+	if err != nil {
+		log.Printf("Failed to open %s for write: %s.", output, err)
+		return
+	}
+	defer outputFile.Close()
+	writer := zip.NewWriter(outputFile)
+	defer writer.Close()
+
+	if err := writeStoredFile(writer, "mimetype", []byte("application/epub+zip")); err != nil {
+		log.Fatalf("Failed to write mimetype: %s.", err)
+	}
+	if err := writeFile(writer, "META-INF/container.xml", `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>`); err != nil {
+		log.Fatalf("Failed to write container.xml: %s.", err)
+	}
+	if err := writeFile(writer, "OEBPS/cover.xhtml", coverXHTML(title, author)); err != nil {
+		log.Fatalf("Failed to write cover.xhtml: %s.", err)
+	}
+	if err := writeFile(writer, "OEBPS/content.opf", contentOPF(title, author, sections)); err != nil {
+		log.Fatalf("Failed to write content.opf: %s.", err)
+	}
+	if err := writeFile(writer, "OEBPS/toc.ncx", tocNCX(title, sections)); err != nil {
+		log.Fatalf("Failed to write toc.ncx: %s.", err)
+	}
+	if err := writeFile(writer, "OEBPS/nav.xhtml", navXHTML(title, sections)); err != nil {
+		log.Fatalf("Failed to write nav.xhtml: %s.", err)
+	}
+	for _, s := range sections {
+		if err := writeFile(writer, fmt.Sprintf("OEBPS/%s.xhtml", s.id), sectionXHTML(s.title, s.body.String())); err != nil {
+			log.Fatalf("Failed to write %s.xhtml: %s.", s.id, err)
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	if len(flag.Args()) == 0 {
+		fmt.Printf("Usage: %s 1.txt [2.txt .. ]\n", os.Args[0])
+		flag.PrintDefaults()
+		return
+	}
+	for _, input := range flag.Args() {
+		if !strings.HasSuffix(input, ".txt") {
+			log.Printf("Don't know how convert %s. Ignore it.", input)
+			continue
+		}
+		output := input[0:len(input)-4] + ".epub"
+		log.Printf("Converting %s to %s ...\n", input, output)
+		ConvertToEpub(input, output)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHeadingTag(t *testing.T) {
+	tests := []struct {
+		depth               int
+		wantOpen, wantClose string
+	}{
+		{0, "<h1>", "</h1>"},
+		{5, "<h6>", "</h6>"},
+		{6, `<p class="h7">`, "</p>"},
+		{7, `<p class="h8">`, "</p>"},
+	}
+	for _, test := range tests {
+		gotOpen, gotClose := headingTag(test.depth)
+		if gotOpen != test.wantOpen || gotClose != test.wantClose {
+			t.Errorf("headingTag(%d) = (%q, %q), want (%q, %q)",
+				test.depth, gotOpen, gotClose, test.wantOpen, test.wantClose)
+		}
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	var buffer bytes.Buffer
+	writeTable(&buffer, []string{"甲|乙", "丙&丁|戊"})
+	want := "<table>\n<tr><td>甲</td><td>乙</td></tr>\n<tr><td>丙&amp;丁</td><td>戊</td></tr>\n</table>\n"
+	if got := buffer.String(); got != want {
+		t.Errorf("writeTable(...) = %q, want %q", got, want)
+	}
+
+	buffer.Reset()
+	writeTable(&buffer, nil)
+	if got := buffer.String(); got != "" {
+		t.Errorf("writeTable(nil) = %q, want empty (no rows, no <table>)", got)
+	}
+}
+
+func TestStripCiteRef(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"plain text", "plain text"},
+		{"見[[cite:shiji]]。", "見shiji。"},
+		{"詳見[[ref:2-3]]。", "詳見2-3。"},
+	}
+	for _, test := range tests {
+		if got := stripCiteRef(test.text); got != test.want {
+			t.Errorf("stripCiteRef(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestSlugAndBookIdentifier(t *testing.T) {
+	tests := []struct {
+		title    string
+		wantSlug string
+	}{
+		{"史記", "book"},
+		{"Shiji 2023", "Shiji2023"},
+	}
+	for _, test := range tests {
+		if got := slug(test.title); got != test.wantSlug {
+			t.Errorf("slug(%q) = %q, want %q", test.title, got, test.wantSlug)
+		}
+		if got, want := bookIdentifier(test.title), "urn:uuid:"+test.wantSlug; got != want {
+			t.Errorf("bookIdentifier(%q) = %q, want %q", test.title, got, want)
+		}
+	}
+}
+
+func TestSectionXHTMLEscapesTitle(t *testing.T) {
+	got := sectionXHTML(`A & B <tag>`, "<p>body</p>")
+	if !strings.Contains(got, "<title>A &amp; B &lt;tag&gt;</title>") {
+		t.Errorf("sectionXHTML title not escaped: %s", got)
+	}
+}
+
+func TestContentOPFIncludesRequiredMetadata(t *testing.T) {
+	sections := []*section{{id: "section1", title: "第一章"}}
+	got := contentOPF("書 & 名", "作者", sections)
+	if !strings.Contains(got, `<dc:identifier id="book-id">urn:uuid:book</dc:identifier>`) {
+		t.Errorf("contentOPF missing dc:identifier matching bookIdentifier: %s", got)
+	}
+	if !strings.Contains(got, "<dc:title>書 &amp; 名</dc:title>") {
+		t.Errorf("contentOPF title not escaped: %s", got)
+	}
+	if !strings.Contains(got, `<meta property="dcterms:modified">`) {
+		t.Errorf("contentOPF missing required dcterms:modified meta: %s", got)
+	}
+	if !strings.Contains(got, `<item id="section1" href="section1.xhtml"`) {
+		t.Errorf("contentOPF missing manifest entry for section: %s", got)
+	}
+}
+
+func TestTocNCXMatchesOPFIdentifier(t *testing.T) {
+	sections := []*section{{id: "section1", title: "第一章 <intro>"}}
+	got := tocNCX("書名", sections)
+	if !strings.Contains(got, `<meta name="dtb:uid" content="urn:uuid:book"/>`) {
+		t.Errorf("tocNCX dtb:uid doesn't match bookIdentifier: %s", got)
+	}
+	if !strings.Contains(got, "第一章 &lt;intro&gt;") {
+		t.Errorf("tocNCX navLabel not escaped: %s", got)
+	}
+}
@@ -4,14 +4,18 @@
 // 3. Merge consecutive spaces into one.
 // 4. Fix unpaired quote.
 // 5. Merge broken paragraphs.
+// 6. Validate (but pass through unchanged) inline ruby/pinyin annotations.
+// 7. Pass a "===refs===" … "===" block of BibTeX entries through verbatim.
 
 package main
 
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"internal/doc"
 	"log"
 	"os"
 	"strings"
@@ -22,6 +26,116 @@ import (
 const startQuote = '“'
 const endQuote = '”'
 
+// kRefsStart/kRefsEnd bracket a "===refs===" … "===" block of raw
+// BibTeX/biblatex entries (see tex.ConvertToTex), passed through
+// verbatim below rather than normalized like body text.
+const kRefsStart = "===refs==="
+const kRefsEnd = "==="
+
+var normalizeMode = flag.String("normalize", "none", "Unicode normalization to apply: none, nfc, or nfkc.")
+var variantsPath = flag.String("variants", "", "TSV file (variant<TAB>canonical) of 異體字 to collapse to their canonical forms.")
+var toSimplified = flag.Bool("t2s", false, "Convert traditional characters to simplified, using a small embedded mapping table.")
+var toTraditional = flag.Bool("s2t", false, "Convert simplified characters to traditional, using a small embedded mapping table.")
+
+// variantSubstitution records one character-level substitution made by
+// -variants, -t2s or -s2t, so a sidecar file can tell callers (e.g. the
+// tex converter) what the original glyph was, for re-insertion as a ruby
+// annotation or footnote.
+type variantSubstitution struct {
+	Line      int    `json:"line"`
+	Column    int    `json:"column"`
+	Original  string `json:"original"`
+	Canonical string `json:"canonical"`
+}
+
+// loadVariantsFile parses a "variant<TAB>canonical" TSV into a rune map.
+// Only single-character entries are supported; anything else is a
+// no-op, logged, since the normalization pass below substitutes rune by
+// rune.
+func loadVariantsFile(path string) map[rune]rune {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %s.", path, err)
+	}
+	defer file.Close()
+	variants := make(map[rune]rune)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		columns := strings.SplitN(line, "\t", 2)
+		if len(columns) != 2 {
+			log.Printf("Ignoring malformed line in %s: %s", path, line)
+			continue
+		}
+		variant, canonical := []rune(columns[0]), []rune(columns[1])
+		if len(variant) != 1 || len(canonical) != 1 {
+			log.Printf("Ignoring non-single-character mapping in %s: %s", path, line)
+			continue
+		}
+		variants[variant[0]] = canonical[0]
+	}
+	return variants
+}
+
+// foldFullwidthASCII maps fullwidth ASCII forms (U+FF01-FF5E) and the
+// ideographic space to their halfwidth equivalents, the one part of NFKC
+// that matters most for these texts.
+func foldFullwidthASCII(line string) string {
+	var buffer strings.Builder
+	for _, r := range line {
+		switch {
+		case r >= 0xFF01 && r <= 0xFF5E:
+			buffer.WriteRune(r - 0xFEE0)
+		case r == '　':
+			buffer.WriteRune(' ')
+		default:
+			buffer.WriteRune(r)
+		}
+	}
+	return buffer.String()
+}
+
+// kComposedLatin covers the common precomposed Latin letters that show up
+// in loanwords and author names inside comments. This repo doesn't vendor
+// golang.org/x/text/unicode/norm, so full Unicode NFC/NFD decomposition
+// tables aren't available; this covers the combining sequences that
+// actually occur in practice instead.
+var kComposedLatin = map[string]rune{
+	"a\u0301": 'á', "e\u0301": 'é', "i\u0301": 'í', "o\u0301": 'ó', "u\u0301": 'ú',
+	"a\u0300": 'à', "e\u0300": 'è', "n\u0303": 'ñ', "o\u0303": 'õ',
+}
+
+func composeLatin(line string) string {
+	for sequence, composed := range kComposedLatin {
+		line = strings.ReplaceAll(line, sequence, string(composed))
+	}
+	return line
+}
+
+// normalizeLine applies -normalize before the quote/whitespace cleanup
+// below, so later passes see already-normalized text.
+func normalizeLine(line string) string {
+	switch *normalizeMode {
+	case "nfc":
+		return composeLatin(line)
+	case "nfkc":
+		return foldFullwidthASCII(composeLatin(line))
+	default:
+		return line
+	}
+}
+
+// validateRubyOrFatal is doc.ValidateRuby, reporting the line number on
+// failure the way every other error in Format does.
+func validateRubyOrFatal(text string, lineNumber int) {
+	if err := doc.ValidateRuby(text); err != nil {
+		log.Fatalf("Error @%d: %s\n", lineNumber, err)
+	}
+}
+
 func Format(input, output string) {
 	// Open input.
 	inputFile, err := os.Open(input)
@@ -39,12 +153,23 @@ func Format(input, output string) {
 	}
 	defer outputFile.Close()
 
+	var variants map[rune]rune
+	if len(*variantsPath) > 0 {
+		variants = loadVariantsFile(*variantsPath)
+	}
+	if *toSimplified && *toTraditional {
+		log.Fatalln("-t2s and -s2t are mutually exclusive.")
+	}
+	var substitutions []variantSubstitution
+
 	var buffer bytes.Buffer
 	inQuote := false
 	inTable := false
+	inRefs := false
 	isSpace := false
 	couldEnd := false
 	lineNumber := 0
+	paragraphStartLine := 0
 	var title, author string
 	for inputScanner.Scan() {
 		line := strings.TrimSpace(inputScanner.Text())
@@ -52,12 +177,27 @@ func Format(input, output string) {
 		if len(line) == 0 {
 			continue
 		}
+		if inRefs {
+			fmt.Fprintln(outputFile, line)
+			if line == kRefsEnd {
+				inRefs = false
+			}
+			continue
+		}
+		if line == kRefsStart {
+			inRefs = true
+			fmt.Fprintln(outputFile, line)
+			continue
+		}
+		line = normalizeLine(line)
 		if len(title) == 0 {
+			validateRubyOrFatal(line, lineNumber)
 			fmt.Fprintln(outputFile, line)
 			title = line
 			continue
 		}
 		if len(author) == 0 {
+			validateRubyOrFatal(line, lineNumber)
 			fmt.Fprintln(outputFile, line)
 			author = line
 			continue
@@ -74,6 +214,7 @@ func Format(input, output string) {
 			continue
 		}
 		if inTable || strings.HasPrefix(line, "+") {
+			validateRubyOrFatal(line, lineNumber)
 			if buffer.Len() > 0 || inQuote {
 				if buffer.Len() > 0 {
 					fmt.Fprintln(outputFile, buffer.String())
@@ -83,7 +224,33 @@ func Format(input, output string) {
 			fmt.Fprintln(outputFile, line)
 			continue
 		}
-		for _, runeValue := range line {
+		if buffer.Len() == 0 {
+			paragraphStartLine = lineNumber
+		}
+		for column, runeValue := range []rune(line) {
+			if canonical, ok := variants[runeValue]; ok {
+				substitutions = append(substitutions, variantSubstitution{
+					Line: lineNumber, Column: column + 1,
+					Original: string(runeValue), Canonical: string(canonical),
+				})
+				runeValue = canonical
+			} else if *toSimplified {
+				if canonical, ok := kTraditionalToSimplified[runeValue]; ok {
+					substitutions = append(substitutions, variantSubstitution{
+						Line: lineNumber, Column: column + 1,
+						Original: string(runeValue), Canonical: string(canonical),
+					})
+					runeValue = canonical
+				}
+			} else if *toTraditional {
+				if canonical, ok := kSimplifiedToTraditional[runeValue]; ok {
+					substitutions = append(substitutions, variantSubstitution{
+						Line: lineNumber, Column: column + 1,
+						Original: string(runeValue), Canonical: string(canonical),
+					})
+					runeValue = canonical
+				}
+			}
 			if unicode.IsSpace(runeValue) {
 				if isSpace {
 					couldEnd = false
@@ -113,16 +280,44 @@ func Format(input, output string) {
 
 		}
 		if couldEnd && !inQuote {
+			// Validate against the fully-merged paragraph, not the raw
+			// physical line: a ruby annotation can be hard-wrapped across
+			// lines in the source and would falsely look unmatched if
+			// checked before merging.
+			validateRubyOrFatal(buffer.String(), paragraphStartLine)
 			fmt.Fprintln(outputFile, buffer.String())
 			buffer.Reset()
 		}
 	}
 	if buffer.Len() > 0 || inQuote {
 		if buffer.Len() > 0 {
+			validateRubyOrFatal(buffer.String(), paragraphStartLine)
 			fmt.Fprintln(outputFile, buffer.String())
 		}
 		log.Fatalln("Error at end of file.")
 	}
+	if inRefs {
+		log.Fatalf("Error: unterminated %s block.\n", kRefsStart)
+	}
+	if len(substitutions) > 0 {
+		writeVariantsSidecar(input, substitutions)
+	}
+}
+
+// writeVariantsSidecar records every -variants/-t2s/-s2t substitution made
+// while formatting input, so downstream tools (e.g. the tex converter)
+// can re-insert the original glyph as a ruby annotation or footnote
+// without losing information.
+func writeVariantsSidecar(input string, substitutions []variantSubstitution) {
+	sidecarPath := input[0:len(input)-len(".txt")] + ".variants.json"
+	encoded, err := json.MarshalIndent(substitutions, "", "  ")
+	if err != nil {
+		log.Printf("Failed to encode %s: %s.", sidecarPath, err)
+		return
+	}
+	if err := os.WriteFile(sidecarPath, encoded, 0644); err != nil {
+		log.Printf("Failed to write %s: %s.", sidecarPath, err)
+	}
 }
 
 func main() {
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFoldFullwidthASCII(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"plain text", "plain text"},
+		{"Ａ１！　Ｂ", "A1! B"},
+		{"中文不變", "中文不變"},
+	}
+	for _, test := range tests {
+		if got := foldFullwidthASCII(test.line); got != test.want {
+			t.Errorf("foldFullwidthASCII(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestComposeLatin(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"café", "café"},
+		{"no accents here", "no accents here"},
+	}
+	for _, test := range tests {
+		if got := composeLatin(test.line); got != test.want {
+			t.Errorf("composeLatin(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeLine(t *testing.T) {
+	saved := *normalizeMode
+	defer func() { *normalizeMode = saved }()
+
+	tests := []struct {
+		mode string
+		line string
+		want string
+	}{
+		{"none", "Ａ１", "Ａ１"},
+		{"nfc", "café", "café"},
+		{"nfkc", "Ａ１　café", "A1 café"},
+	}
+	for _, test := range tests {
+		*normalizeMode = test.mode
+		if got := normalizeLine(test.line); got != test.want {
+			t.Errorf("normalizeLine(%q) with -normalize=%s = %q, want %q",
+				test.line, test.mode, got, test.want)
+		}
+	}
+}
+
+func TestLoadVariantsFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "variants.tsv")
+	content := "异\t異\n\n体\t體\nbroken-line-no-tab\nab\tc\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write fixture: %s", err)
+	}
+	got := loadVariantsFile(path)
+	want := map[rune]rune{'异': '異', '体': '體'}
+	if len(got) != len(want) {
+		t.Fatalf("loadVariantsFile(%q) = %v, want %v", path, got, want)
+	}
+	for r, canonical := range want {
+		if got[r] != canonical {
+			t.Errorf("loadVariantsFile(%q)[%q] = %q, want %q", path, r, got[r], canonical)
+		}
+	}
+}
+
+// TestFormatWritesVariantsSidecar exercises Format end-to-end with -variants
+// set, checking both the normalized output and the substitution sidecar
+// (see writeVariantsSidecar) that downstream tools rely on to re-insert the
+// original glyph.
+func TestFormatWritesVariantsSidecar(t *testing.T) {
+	dir := t.TempDir()
+	variantsPathFlag := filepath.Join(dir, "variants.tsv")
+	if err := os.WriteFile(variantsPathFlag, []byte("异\t異\n"), 0644); err != nil {
+		t.Fatalf("failed to write fixture: %s", err)
+	}
+	input := filepath.Join(dir, "book.txt")
+	if err := os.WriteFile(input, []byte("書名\n作者\n\n异文。\n"), 0644); err != nil {
+		t.Fatalf("failed to write fixture: %s", err)
+	}
+
+	savedPath := *variantsPath
+	*variantsPath = variantsPathFlag
+	defer func() { *variantsPath = savedPath }()
+
+	output := filepath.Join(dir, "book.new.txt")
+	Format(input, output)
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("failed to read %s: %s", output, err)
+	}
+	want := "書名\n作者\n異文。\n"
+	if string(got) != want {
+		t.Errorf("Format output = %q, want %q", string(got), want)
+	}
+
+	sidecarPath := input[:len(input)-len(".txt")] + ".variants.json"
+	sidecar, err := os.ReadFile(sidecarPath)
+	if err != nil {
+		t.Fatalf("failed to read sidecar %s: %s", sidecarPath, err)
+	}
+	var substitutions []variantSubstitution
+	if err := json.Unmarshal(sidecar, &substitutions); err != nil {
+		t.Fatalf("failed to parse sidecar %s: %s", sidecarPath, err)
+	}
+	want_sub := variantSubstitution{Line: 4, Column: 1, Original: "异", Canonical: "異"}
+	if len(substitutions) != 1 || substitutions[0] != want_sub {
+		t.Errorf("sidecar substitutions = %v, want [%v]", substitutions, want_sub)
+	}
+}
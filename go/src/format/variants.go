@@ -0,0 +1,31 @@
+// This file contains a small built-in traditional<->simplified mapping
+// table, in the spirit of OpenCC's character-level conversion tables but
+// far from complete: it only covers a few dozen of the most common
+// characters. Format applies it to body paragraphs only; the title,
+// author, heading and table lines are not converted. Anything it misses
+// should go in a -variants.tsv file instead.
+
+package main
+
+var kTraditionalToSimplified = map[rune]rune{
+	'國': '国', '書': '书', '漢': '汉', '語': '语', '會': '会',
+	'學': '学', '長': '长', '東': '东', '車': '车', '門': '门',
+	'開': '开', '關': '关', '後': '后', '體': '体', '點': '点',
+	'電': '电', '時': '时', '對': '对', '萬': '万', '與': '与',
+	'義': '义', '業': '业', '專': '专', '為': '为', '無': '无',
+	'愛': '爱', '從': '从', '來': '来', '個': '个', '這': '这',
+	'麼': '么', '們': '们', '說': '说', '話': '话', '買': '买',
+	'賣': '卖', '錢': '钱', '師': '师', '經': '经', '紀': '纪',
+	'統': '统', '總': '总', '歷': '历', '歲': '岁', '舊': '旧',
+	'樂': '乐', '聽': '听', '見': '见', '聞': '闻', '讀': '读',
+}
+
+var kSimplifiedToTraditional = invertRuneMap(kTraditionalToSimplified)
+
+func invertRuneMap(m map[rune]rune) map[rune]rune {
+	inverted := make(map[rune]rune, len(m))
+	for from, to := range m {
+		inverted[to] = from
+	}
+	return inverted
+}
@@ -0,0 +1,190 @@
+// Package doc parses the section-heading and parenthetical-comment syntax
+// shared by the txt input format (see README), so that the tex and epub
+// output backends stay in sync instead of drifting apart.
+package doc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// SectionNames maps a heading depth (0 == one leading "+") to its name.
+var SectionNames = [...]string{
+	"part",
+	"chapter",
+	"section",
+	"subsection",
+	"subsubsection",
+	"subsubsubsection",
+	"paragraph",
+	"subparagraph",
+}
+
+// ParseTitleLine parses a "+"-prefixed heading line, e.g.
+// 1) "+XXX" is part.
+// 2) "++XXX" is chapter.
+// 3) "+++XXX" is section.
+// 4) "++++XXX" is subsection.
+// 5) "+++++XXX" is subsubsection.
+// 6) "++++++XXX" is subsubsubsection.
+// 7) "+++++++XXX" is paragraph.
+// 8) "++++++++XXX" is subparagraph.
+// Returns
+//
+//	"sectionType" the section depth, 0..len(SectionNames)-1.
+//	"outTitle" the section title. (XXX)
+func ParseTitleLine(title string) (sectionType int, outTitle string) {
+	numOfPlus := 0
+	for numOfPlus < len(title) && title[numOfPlus] == '+' {
+		numOfPlus++
+	}
+	if numOfPlus < 1 || numOfPlus > len(SectionNames) {
+		log.Fatalf("Unknown title: %s.", title)
+	}
+	outTitle = title[numOfPlus:]
+	sectionType = numOfPlus - 1
+	return
+}
+
+const CommentStart = "（"
+const CommentEnd = "）"
+
+// ReplaceComment walks text looking for（…）parenthetical comments,
+// honoring nesting (（outer（inner）outer）), and passes each comment's
+// inner text -- with any nested comments already resolved -- to render,
+// which returns the markup to splice in its place. Backends use this to
+// turn the same source syntax into whatever their comment rendering
+// looks like (TeX \scriptsize/\footnote/..., an HTML <span>, ...).
+func ReplaceComment(text string, render func(comment string) string) string {
+	var buffer bytes.Buffer
+	for {
+		start := strings.Index(text, CommentStart)
+		if start == -1 {
+			break
+		}
+		if start > 0 {
+			buffer.WriteString(text[:start])
+		}
+		depth := 1
+		pos := start + len(CommentStart)
+		for depth > 0 {
+			nextStart := strings.Index(text[pos:], CommentStart)
+			nextEnd := strings.Index(text[pos:], CommentEnd)
+			if nextEnd == -1 {
+				log.Fatalf("Invalid comment: %s\n", text)
+			}
+			if nextStart != -1 && nextStart < nextEnd {
+				depth++
+				pos += nextStart + len(CommentStart)
+			} else {
+				depth--
+				pos += nextEnd + len(CommentEnd)
+			}
+		}
+		inner := text[start+len(CommentStart) : pos-len(CommentEnd)]
+		buffer.WriteString(render(ReplaceComment(inner, render)))
+		text = text[pos:]
+		if len(text) == 0 {
+			break
+		}
+	}
+	if len(text) > 0 {
+		buffer.WriteString(text)
+	}
+	return buffer.String()
+}
+
+// kRubyPattern matches the two inline ruby/pinyin syntaxes:｛字｜pīn｝ and
+// the ASCII-friendly {{字/pīn}}. The ASCII form needs doubled braces, not
+// bare "[字/pīn]": a single "[...]" collides with ordinary bracketed
+// asides that happen to contain a "/", e.g. a citation note like
+// "[史記/卷六]", which would otherwise be silently misread as ruby markup.
+var kRubyPattern = regexp.MustCompile(`｛([^｜｝]+)｜([^｝]+)｝|\{\{([^/}]+)/([^}]+)\}\}`)
+
+// ReplaceRuby walks text looking for inline ruby annotations and, for
+// plain-text runes not already covered by one, consults bulk (may be
+// nil) for a per-character reading loaded from a sidecar TSV. Every
+// match -- inline or bulk -- is passed to render(char, reading), which
+// returns the markup to splice in its place.
+func ReplaceRuby(text string, bulk map[rune]string, render func(char, reading string) string) string {
+	var buffer bytes.Buffer
+	last := 0
+	for _, m := range kRubyPattern.FindAllStringSubmatchIndex(text, -1) {
+		buffer.WriteString(replaceBulkRuby(text[last:m[0]], bulk, render))
+		var char, reading string
+		if m[2] == -1 {
+			char, reading = text[m[6]:m[7]], text[m[8]:m[9]]
+		} else {
+			char, reading = text[m[2]:m[3]], text[m[4]:m[5]]
+		}
+		buffer.WriteString(render(char, reading))
+		last = m[1]
+	}
+	buffer.WriteString(replaceBulkRuby(text[last:], bulk, render))
+	return buffer.String()
+}
+
+func replaceBulkRuby(text string, bulk map[rune]string, render func(char, reading string) string) string {
+	if len(bulk) == 0 {
+		return text
+	}
+	var buffer bytes.Buffer
+	for _, r := range text {
+		if reading, ok := bulk[r]; ok {
+			buffer.WriteString(render(string(r), reading))
+		} else {
+			buffer.WriteRune(r)
+		}
+	}
+	return buffer.String()
+}
+
+// HasRuby reports whether text contains at least one inline ruby
+// annotation, so callers can decide whether to declare ruby support
+// (e.g. a TeX package) only when the input actually needs it.
+func HasRuby(text string) bool {
+	return kRubyPattern.MatchString(text)
+}
+
+// ValidateRuby reports a malformed ruby annotation: an unmatched｛｜｝, or
+// a "{{...}}" that looks like an annotation but is missing its
+// "/reading".
+func ValidateRuby(text string) error {
+	remaining := kRubyPattern.ReplaceAllString(text, "")
+	if strings.ContainsAny(remaining, "｛｜｝") || strings.Contains(remaining, "{{") || strings.Contains(remaining, "}}") {
+		return fmt.Errorf("malformed ruby annotation: %s", text)
+	}
+	return nil
+}
+
+// LoadCharacterReadings parses a "character<TAB>reading" TSV for bulk
+// ruby annotation of rare characters that aren't worth marking up inline
+// throughout a whole book.
+func LoadCharacterReadings(path string) (map[rune]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	readings := make(map[rune]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		columns := strings.SplitN(line, "\t", 2)
+		if len(columns) != 2 {
+			continue
+		}
+		if chars := []rune(columns[0]); len(chars) == 1 {
+			readings[chars[0]] = columns[1]
+		}
+	}
+	return readings, scanner.Err()
+}
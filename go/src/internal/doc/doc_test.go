@@ -0,0 +1,61 @@
+package doc
+
+import "testing"
+
+func TestParseTitleLine(t *testing.T) {
+	tests := []struct {
+		title        string
+		wantType     int
+		wantOutTitle string
+	}{
+		{"+Part", 0, "Part"},
+		{"++Chapter", 1, "Chapter"},
+		{"+++Section", 2, "Section"},
+		{"++++++++Subparagraph", 7, "Subparagraph"},
+	}
+	for _, test := range tests {
+		gotType, gotOutTitle := ParseTitleLine(test.title)
+		if gotType != test.wantType || gotOutTitle != test.wantOutTitle {
+			t.Errorf("ParseTitleLine(%q) = (%d, %q), want (%d, %q)",
+				test.title, gotType, gotOutTitle, test.wantType, test.wantOutTitle)
+		}
+	}
+}
+
+func TestReplaceRuby(t *testing.T) {
+	render := func(char, reading string) string { return char + "(" + reading + ")" }
+	tests := []struct {
+		name string
+		text string
+		bulk map[rune]string
+		want string
+	}{
+		{"fullwidth form", "這是｛字｜zì｝的例子。", nil, "這是字(zì)的例子。"},
+		{"doubled-brace ASCII form", "這是{{字/zì}}的例子。", nil, "這是字(zì)的例子。"},
+		{"single-bracket aside is left alone", "參見[史記/卷六]。", nil, "參見[史記/卷六]。"},
+		{"bulk reading applies to bare characters", "佢哋", map[rune]string{'佢': "kěui"}, "佢(kěui)哋"},
+		{"inline annotation wins over bulk for the same character", "｛字｜zì｝", map[rune]string{'字': "other"}, "字(zì)"},
+	}
+	for _, test := range tests {
+		if got := ReplaceRuby(test.text, test.bulk, render); got != test.want {
+			t.Errorf("%s: ReplaceRuby(%q) = %q, want %q", test.name, test.text, got, test.want)
+		}
+	}
+}
+
+func TestReplaceComment(t *testing.T) {
+	render := func(comment string) string { return "[" + comment + "]" }
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"plain text", "plain text"},
+		{"前（注）後", "前[注]後"},
+		{"前（外（內）外）後", "前[外[內]外]後"},
+	}
+	for _, test := range tests {
+		if got := ReplaceComment(test.text, render); got != test.want {
+			t.Errorf("ReplaceComment(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
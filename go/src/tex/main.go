@@ -17,23 +17,241 @@
 // You need at least the following packages to run xelatex:
 //     sudo apt-get install texlive-xetex texlive-lang-cjk cjk-latex
 // Suggest to use https://www.tug.org/texlive/acquire-netinstall.html.
+//
+// If the input has a ===refs=== block, also run biber (not bibtex) on the
+// generated .bib sidecar between xelatex passes.
 
 package main
 
 import (
 	"bufio"
-	"bytes"
 	"flag"
 	"fmt"
+	"internal/doc"
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 )
 
 var fontName = flag.String("font-name", "HanaMinA", "The font name.")
-var fallbackFontName = flag.String("fallback-font-name", "HanaMinB", "The fallback font name, for rare words not covered by the default font.")
 var titleFontName = flag.String("title-font-name", "KaiTi", "The title font name.")
 var fontSize = flag.Int("font-size", 16, "The font size. This default setting is for 9inch kindle.")
+var vertical = flag.Bool("vertical", false, "Typeset in traditional vertical (top-to-bottom, right-to-left) CJK layout, as luatexko's vertical option does. Natural for ancient Chinese texts.")
+var commentsMode = flag.String("comments", "inline", "How to render（…）parenthetical comments: inline, footnote, endnote, or marginpar (眼批, useful in vertical mode).")
+var scanUnicodeBlocks = flag.Bool("scan-unicode-blocks", true, "Scan each input file and only declare per-block fallback font routing (see -fallback) for the rare-character blocks it actually contains.")
+var rubyReadings = flag.String("ruby-readings", "", "TSV file (character<TAB>reading) of bulk ruby/pinyin annotations for rare characters that aren't marked up inline (see doc.ReplaceRuby).")
+
+// fallbackFonts collects a repeatable -fallback flag into an ordered
+// list, e.g. -fallback HanaMinB -fallback HanaMinC -fallback NotoSerifCJK.
+type fallbackFontList []string
+
+func (f *fallbackFontList) String() string { return strings.Join(*f, ",") }
+
+func (f *fallbackFontList) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+var fallbackFonts fallbackFontList
+
+func init() {
+	flag.Var(&fallbackFonts, "fallback", "Fallback CJK font for characters -font-name doesn't cover, in priority order. Repeat to add more, e.g. -fallback HanaMinB -fallback HanaMinC. Defaults to HanaMinB.")
+}
+
+// unicodeBlock is a contiguous rare-character range that a particular
+// fallback font is known to cover, e.g. the CJK Unified Ideographs
+// extensions or the older scripts (Oracle Bone, Tangut) that full-coverage
+// fonts like HanaMin split across several font files.
+type unicodeBlock struct {
+	name      string
+	low, high rune
+}
+
+var kFallbackBlocks = map[string][]unicodeBlock{
+	"hanaminb": {
+		{"CJK-Ext-B", 0x20000, 0x2A6DF},
+		{"CJK-Ext-C", 0x2A700, 0x2B73F},
+		{"CJK-Ext-D", 0x2B740, 0x2B81F},
+	},
+	"hanaminc": {
+		{"CJK-Ext-E", 0x2B820, 0x2CEAF},
+		{"CJK-Ext-F", 0x2CEB0, 0x2EBEF},
+	},
+	"oracle": {
+		{"Oracle-Bone", 0x13000, 0x1342F},
+	},
+	"tangut": {
+		{"Tangut", 0x17000, 0x187FF},
+	},
+}
+
+// fontBlocksCovered looks up the rare-character blocks a fallback font is
+// known to cover, matched by a case-insensitive substring of its name
+// (e.g. "Hanamin-Oracle" matches "oracle").
+func fontBlocksCovered(fontName string) []unicodeBlock {
+	lower := strings.ToLower(fontName)
+	for key, blocks := range kFallbackBlocks {
+		if strings.Contains(lower, key) {
+			return blocks
+		}
+	}
+	return nil
+}
+
+// scanPresentBlocks reads input and returns the set of block names (see
+// kFallbackBlocks) it actually contains, so ConvertToTex can skip
+// declaring routing for rare-character fonts the book doesn't need.
+func scanPresentBlocks(input string) map[string]bool {
+	file, err := os.Open(input)
+	if err != nil {
+		log.Printf("Failed to open %s to scan for Unicode blocks: %s.", input, err)
+		return nil
+	}
+	defer file.Close()
+	present := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		for _, r := range scanner.Text() {
+			for _, blocks := range kFallbackBlocks {
+				for _, b := range blocks {
+					if r >= b.low && r <= b.high {
+						present[b.name] = true
+					}
+				}
+			}
+		}
+	}
+	return present
+}
+
+// scanHasRuby reports whether input contains at least one inline ruby
+// annotation, so ConvertToTex only declares \usepackage{ruby} when it's
+// actually needed.
+func scanHasRuby(input string) bool {
+	file, err := os.Open(input)
+	if err != nil {
+		log.Printf("Failed to open %s to scan for ruby annotations: %s.", input, err)
+		return false
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if doc.HasRuby(scanner.Text()) {
+			return true
+		}
+	}
+	return false
+}
+
+// renderRuby turns one inline or bulk ruby/pinyin annotation into the
+// \ruby{字}{pīn} command from the ruby package.
+func renderRuby(char, reading string) string {
+	return fmt.Sprintf(`\ruby{%s}{%s}`, char, reading)
+}
+
+const kRefsStart = "===refs==="
+const kRefsEnd = "==="
+
+// scanRefsBlock looks for a top-level "===refs===" … "===" block holding
+// BibTeX/biblatex entries and, if found, writes them verbatim to a .bib
+// sidecar next to input so ConvertToTex can \addbibresource it.
+func scanRefsBlock(input string) (bibPath string, ok bool) {
+	file, err := os.Open(input)
+	if err != nil {
+		log.Printf("Failed to open %s to scan for a refs block: %s.", input, err)
+		return "", false
+	}
+	defer file.Close()
+	var entries []string
+	found := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) != kRefsStart {
+			continue
+		}
+		found = true
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == kRefsEnd {
+				break
+			}
+			entries = append(entries, line)
+		}
+		break
+	}
+	if !found {
+		return "", false
+	}
+	bibPath = strings.TrimSuffix(input, ".txt") + ".bib"
+	if err := os.WriteFile(bibPath, []byte(strings.Join(entries, "\n")+"\n"), 0644); err != nil {
+		log.Printf("Failed to write %s: %s.", bibPath, err)
+		return "", false
+	}
+	return bibPath, true
+}
+
+// kCiteRefPattern matches the inline bibliography/cross-reference tokens:
+// [[cite:key]], [[ref:label]] and [[see:label]].
+var kCiteRefPattern = regexp.MustCompile(`\[\[(cite|ref|see):([^\]]+)\]\]`)
+
+// renderCiteRef turns [[cite:key]] into \parencite{key}, and
+// [[ref:label]] / [[see:label]] into a \hyperref pointing at the
+// \label{sec:label} that sectionSlug auto-generates for every section.
+func renderCiteRef(text string) string {
+	return kCiteRefPattern.ReplaceAllStringFunc(text, func(token string) string {
+		m := kCiteRefPattern.FindStringSubmatch(token)
+		kind, target := m[1], m[2]
+		switch kind {
+		case "cite":
+			return fmt.Sprintf(`\parencite{%s}`, target)
+		case "see":
+			return fmt.Sprintf(`\hyperref[sec:%s]{见%s}`, target, target)
+		default: // "ref"
+			return fmt.Sprintf(`\hyperref[sec:%s]{%s}`, target, target)
+		}
+	})
+}
+
+// sectionSlug builds the predictable label suffix an author writes as
+// [[see:<slug>]]: the section's position at every heading depth down to
+// its own, starting from the part, e.g. "2-3" for the 3rd chapter of the
+// 2nd part.
+func sectionSlug(counts [len(doc.SectionNames)]int, sectionType int) string {
+	parts := make([]string, sectionType+1)
+	for i := 0; i <= sectionType; i++ {
+		parts[i] = fmt.Sprintf("%d", counts[i])
+	}
+	return strings.Join(parts, "-")
+}
+
+// kAnchorComment matches the `（*anchor*注文）` syntax: a note whose
+// anchor is referenced elsewhere, e.g. for cross-references.
+var kAnchorComment = regexp.MustCompile(`(?s)^\*([^*]+)\*(.*)$`)
+
+// renderComment turns one（…）comment (with any nested comments already
+// resolved by doc.ReplaceComment) into TeX, following -comments. A
+// leading `*anchor*` names the note so it can be targeted with \ref, and
+// blank lines inside a multi-paragraph comment become \par.
+func renderComment(comment string) string {
+	label := ""
+	if m := kAnchorComment.FindStringSubmatch(comment); m != nil {
+		label = fmt.Sprintf(`\label{note:%s}`, m[1])
+		comment = m[2]
+	}
+	comment = strings.ReplaceAll(comment, "\n\n", ` \par `)
+	switch *commentsMode {
+	case "footnote":
+		return label + fmt.Sprintf(`\footnote{%s}`, comment)
+	case "endnote":
+		return label + fmt.Sprintf(`\endnote{%s}`, comment)
+	case "marginpar":
+		return label + fmt.Sprintf(`\marginpar{\scriptsize %s}`, comment)
+	default:
+		return label + fmt.Sprintf(`{\scriptsize %s}`, comment)
+	}
+}
 
 func GetLongtableDef() string {
 	return `\usepackage{longtable,tabulary}
@@ -60,91 +278,52 @@ func GetLongtableDef() string {
 \makeatother`
 }
 
+// GetVerticalPreamble returns the preamble fragment that switches the
+// document to traditional vertical (top-to-bottom, right-to-left) CJK
+// typesetting, as luatexko's "vertical" option does under LuaTeX. Since
+// this tool targets xelatex, we emit the documented XeTeX fallback
+// instead: swap the page dimensions and mark every page rotated via
+// \XeTeXpdfpagesattr (the XeTeX-native primitive; \pdfpagesattr is
+// pdfTeX-only and undefined under xelatex). Because this rotates the
+// whole page, individual elements (title page, TOC, tables) must NOT
+// additionally rotate themselves -- that would turn them upside down
+// relative to the rest of the book. The actual vertical glyph forms for
+// rotated punctuation (full-width commas, periods, and the corner quotes
+// 「」『』) come from the vert/vrt2 OpenType features requested on
+// \setCJKmainfont, not from anything here.
+func GetVerticalPreamble() string {
+	return `\newdimen\vpagewidth
+\vpagewidth=\pdfpagewidth
+\pdfpagewidth=\pdfpageheight
+\pdfpageheight=\vpagewidth
+\XeTeXpdfpagesattr{/Rotate 90}`
+}
+
 func GetTitlePage(title, author string) string {
-	return fmt.Sprintf(
-		`\begin{titlepage}
-\begin{center}
-\vspace*{\fill}
+	content := fmt.Sprintf(
+		`\vspace*{\fill}
 \emph{\textbf{\Huge{\kaiti %s}}}\\[0.5cm]
 {\normalsize %s}\\[1.5cm]
 {\small\url{https://code.google.com/p/ancient-chinese}}\\
 {\small\today}
-\vspace*{\fill}
+\vspace*{\fill}`, title, author)
+	return fmt.Sprintf(
+		`\begin{titlepage}
+\begin{center}
+%s
 \end{center}
-\end{titlepage}`, title, author)
-}
-
-var kSectionNames = [...]string{
-	"part",
-	"chapter",
-	"section",
-	"subsection",
-	"subsubsection",
-	"subsubsubsection",
-	"paragraph",
-	"subparagraph",
+\end{titlepage}`, content)
 }
 
-// "title" is like
-// 1) "+XXX" is part.
-// 2) "++XXX" is chapter.
-// 3) "+++XXX" is section.
-// 4) "++++XXX" is subsection.
-// 5) "+++++XXX" is subsubsection.
-// 6) "++++++XXX" is subsubsubsection.
-// 7) "+++++++XXX" is paragraph.
-// 8) "++++++++XXX" is subparagraph.
-// Returns
-//   "start" the tex script to start the section.
-//   "sectionType" the section type, 0..7.
-//   "outTitle" the section title. (XXX)
-func ParseTitleLine(title string) (sectionType int, start, outTitle string) {
-	numOfPlus := 0
-	for numOfPlus < len(title) && title[numOfPlus] == '+' {
-		numOfPlus++
-	}
-	if numOfPlus < 1 || numOfPlus > len(kSectionNames) {
-		log.Fatalf("Unknown title: %s.", title)
-	}
-	outTitle = title[numOfPlus:]
-	if numOfPlus == 2 {
+// sectionStart returns the TeX commands that should precede a section of
+// the given depth: a \cleardoublepage before each chapter, plus the
+// \phantomsection every heading needs for hyperref to link to it.
+func sectionStart(sectionType int) string {
+	start := ""
+	if sectionType == 1 {
 		start = `\cleardoublepage`
-	} else {
-		start = ""
 	}
-	sectionType = numOfPlus - 1
-	start += `\phantomsection`
-	return
-}
-
-var kCommentStart = "（"
-var kCommentEnd = "）"
-
-func ReplaceCommentWithScript(text string) string {
-	var buffer bytes.Buffer
-	for {
-		start := strings.Index(text, kCommentStart)
-		if start == -1 {
-			break
-		}
-		end := strings.Index(text, kCommentEnd)
-		if start > 0 {
-			buffer.WriteString(text[:start])
-		}
-		start += len(kCommentStart)
-		if start >= end {
-			log.Fatalf("Invalid comment: %s\n", text)
-		}
-		buffer.WriteString(fmt.Sprintf(`{\scriptsize %s}`, text[start:end]))
-		text = text[end+len(kCommentEnd):]
-		if len(text) == 0 {
-			break
-		}
-	}
-	if len(text) > 0 {
-		buffer.WriteString(text)
-	}
-	return buffer.String()
+	return start + `\phantomsection`
 }
 
 func ConvertToTex(input, output string) {
@@ -164,19 +343,83 @@ func ConvertToTex(input, output string) {
 	}
 	defer outputFile.Close()
 
+	var bulkReadings map[rune]string
+	if len(*rubyReadings) > 0 {
+		var err error
+		bulkReadings, err = doc.LoadCharacterReadings(*rubyReadings)
+		if err != nil {
+			log.Fatalf("Failed to load %s: %s.", *rubyReadings, err)
+		}
+	}
+	bibPath, hasRefs := scanRefsBlock(input)
+
+	// renderText resolves inline citations/cross-references, ruby
+	// annotations, and（…）comments in a line of body or heading text, in
+	// that order since the three syntaxes never overlap.
+	renderText := func(text string) string {
+		return doc.ReplaceComment(doc.ReplaceRuby(renderCiteRef(text), bulkReadings, renderRuby), renderComment)
+	}
+
 	// Ouput headers.
 	fmt.Fprintf(outputFile, "\\documentclass[fontsize=%dpt]{scrbook}\n", *fontSize)
 	fmt.Fprintln(outputFile, `\KOMAoptions{twoside=false}`)
 	fmt.Fprintln(outputFile, `\usepackage{hyperref}`)
 	fmt.Fprintln(outputFile, `\usepackage{indentfirst}`)
+	if *commentsMode == "endnote" {
+		fmt.Fprintln(outputFile, `\usepackage{endnotes}`)
+	}
+	if len(bulkReadings) > 0 || scanHasRuby(input) {
+		fmt.Fprintln(outputFile, `\usepackage{ruby}`)
+	}
+	if hasRefs {
+		fmt.Fprintln(outputFile, `\usepackage[backend=biber,style=authoryear]{biblatex}`)
+		fmt.Fprintf(outputFile, "\\addbibresource{%s}\n", filepath.Base(bibPath))
+	}
 	fmt.Fprintln(outputFile, GetLongtableDef())
 	fmt.Fprintln(outputFile, `\usepackage{xeCJK}`)
 	fmt.Fprintln(outputFile, `\xeCJKsetup{AutoFallBack}`)
 	fmt.Fprintln(outputFile, `\CJKspace`)
-	fmt.Fprintf(outputFile, "\\setCJKmainfont[FallBack=%s]{%s}\n", *fallbackFontName, *fontName)
+	fallbacks := []string(fallbackFonts)
+	if len(fallbacks) == 0 {
+		fallbacks = []string{"HanaMinB"}
+	}
+	fontOptions := fmt.Sprintf("FallBack=%s", strings.Join(fallbacks, ","))
+	if *vertical {
+		// Select the font's vertical (rotated) presentation forms for
+		// punctuation via the vert/vrt2 OpenType features -- without this,
+		// ，。「」『』 etc. just sit sideways on the rotated page instead of
+		// actually rotating to their vertical glyph forms.
+		fontOptions += ",RawFeature={+vert;+vrt2}"
+	}
+	fmt.Fprintf(outputFile, "\\setCJKmainfont[%s]{%s}\n", fontOptions, *fontName)
+	var presentBlocks map[string]bool
+	if *scanUnicodeBlocks {
+		presentBlocks = scanPresentBlocks(input)
+	}
+	for i, fallback := range fallbacks {
+		var ranges []string
+		for _, b := range fontBlocksCovered(fallback) {
+			if presentBlocks != nil && !presentBlocks[b.name] {
+				continue
+			}
+			ranges = append(ranges, fmt.Sprintf("\"%X->\"%X", b.low, b.high))
+		}
+		if len(ranges) == 0 {
+			continue
+		}
+		family := fmt.Sprintf("fallback%d", i)
+		// Route each rare-character block covered by this fallback font to
+		// its own CJK family, so e.g. Oracle Bone or Tangut characters don't
+		// depend on xeCJK's generic FallBack= search order.
+		fmt.Fprintf(outputFile, "\\newCJKfontfamily[%s]\\%s{%s}\n", family, family, fallback)
+		fmt.Fprintf(outputFile, "\\xeCJKDeclareCharClass{%s}{%s}\n", family, strings.Join(ranges, ","))
+	}
 	fmt.Fprintf(outputFile, "\\newCJKfontfamily[kai]\\kaiti{%s}\n", *titleFontName)
 	fmt.Fprintln(outputFile, `\XeTeXlinebreaklocale "zh"`)
 	fmt.Fprintln(outputFile, `\XeTeXlinebreakskip 0pt plus 1pt`)
+	if *vertical {
+		fmt.Fprintln(outputFile, GetVerticalPreamble())
+	}
 	fmt.Fprintln(outputFile, `\usepackage{fancyhdr}`)
 	fmt.Fprintln(outputFile, `\pagestyle{fancy}`)
 	fmt.Fprintln(outputFile, `\setcounter{secnumdepth}{-1}`)
@@ -189,8 +432,9 @@ func ConvertToTex(input, output string) {
 	var title string
 	var author string
 	const kTableMarker = "---"
-	var sectionTypeToCount [len(kSectionNames)]int
-	var sectionTypeToTitle [len(kSectionNames)]string
+	var sectionTypeToCount [len(doc.SectionNames)]int
+	var sectionTypeToTitle [len(doc.SectionNames)]string
+	hasChapter := false
 	for inputScanner.Scan() {
 		line := strings.TrimSpace(inputScanner.Text())
 		if len(line) == 0 {
@@ -204,6 +448,14 @@ func ConvertToTex(input, output string) {
 			fmt.Fprintln(outputFile, GetTitlePage(title, author))
 			fmt.Fprintln(outputFile, `\tableofcontents{}`)
 			fmt.Fprintln(outputFile, `\newpage`)
+		} else if line == kRefsStart {
+			// Already captured into bibPath by scanRefsBlock; just skip
+			// past it here so it isn't rendered as body text.
+			for inputScanner.Scan() {
+				if strings.TrimSpace(inputScanner.Text()) == kRefsEnd {
+					break
+				}
+			}
 		} else if line == kTableMarker {
 			var tableRows []string
 			for inputScanner.Scan() {
@@ -244,25 +496,45 @@ func ConvertToTex(input, output string) {
 			fmt.Fprintln(outputFile, `\end{scriptsize}`)
 			fmt.Fprintln(outputFile, `\par`)
 		} else if line[0] == '+' {
-			sectionType, start, title := ParseTitleLine(line)
-			sectionTypeName := kSectionNames[sectionType]
+			sectionType, title := doc.ParseTitleLine(line)
+			start := sectionStart(sectionType)
+			sectionTypeName := doc.SectionNames[sectionType]
 			if sectionTypeToTitle[sectionType] == title {
 				fmt.Printf("Ignoring %s: %s\n", sectionTypeName, title)
 				continue
 			}
+			if sectionType == 1 && *commentsMode == "endnote" && hasChapter {
+				fmt.Fprintln(outputFile, `\theendnotes`)
+			}
+			if sectionType == 1 {
+				hasChapter = true
+			}
 			sectionTypeToTitle[sectionType] = title
 			sectionTypeToCount[sectionType]++
-			for i := sectionType + 1; i < len(kSectionNames); i++ {
+			for i := sectionType + 1; i < len(doc.SectionNames); i++ {
 				sectionTypeToTitle[i] = ""
 				sectionTypeToCount[i] = 0
 			}
 			fmt.Printf("%s %d: %s\n", sectionTypeName, sectionTypeToCount[sectionType], title)
-			fmt.Fprintf(outputFile, "%s\n\\%s{%s}\n", start, sectionTypeName, ReplaceCommentWithScript(title))
+			fmt.Fprintf(outputFile, "%s\n\\%s{%s}\n", start, sectionTypeName, renderText(title))
+			fmt.Fprintf(outputFile, "\\label{sec:%s}\n", sectionSlug(sectionTypeToCount, sectionType))
 		} else {
-			fmt.Fprintln(outputFile, "\\par\n"+ReplaceCommentWithScript(line))
+			// A comment left open across this line (more（than）) spans
+			// multiple source lines; keep reading until it closes, joining
+			// with a blank line so renderComment can tell paragraphs apart.
+			for strings.Count(line, doc.CommentStart) > strings.Count(line, doc.CommentEnd) && inputScanner.Scan() {
+				line += "\n\n" + strings.TrimSpace(inputScanner.Text())
+			}
+			fmt.Fprintln(outputFile, "\\par\n"+renderText(line))
 		}
 
 	}
+	if *commentsMode == "endnote" && hasChapter {
+		fmt.Fprintln(outputFile, `\theendnotes`)
+	}
+	if hasRefs {
+		fmt.Fprintln(outputFile, `\printbibliography`)
+	}
 	fmt.Fprintln(outputFile, `\end{document}`)
 }
 
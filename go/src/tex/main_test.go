@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestRenderCiteRef(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"plain text", "plain text"},
+		{"見[[cite:shiji]]。", `見\parencite{shiji}。`},
+		{"詳見[[ref:2-3]]。", `詳見\hyperref[sec:2-3]{2-3}。`},
+		{"詳見[[see:2-3]]。", `詳見\hyperref[sec:2-3]{见2-3}。`},
+	}
+	for _, test := range tests {
+		if got := renderCiteRef(test.text); got != test.want {
+			t.Errorf("renderCiteRef(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestSectionSlug(t *testing.T) {
+	var counts [8]int
+	counts[0], counts[1], counts[2] = 2, 3, 1
+	tests := []struct {
+		sectionType int
+		want        string
+	}{
+		{0, "2"},
+		{1, "2-3"},
+		{2, "2-3-1"},
+	}
+	for _, test := range tests {
+		if got := sectionSlug(counts, test.sectionType); got != test.want {
+			t.Errorf("sectionSlug(%v, %d) = %q, want %q", counts, test.sectionType, got, test.want)
+		}
+	}
+}